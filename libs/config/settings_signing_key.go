@@ -0,0 +1,18 @@
+package config
+
+import "os"
+
+// settingsSigningKeyEnvVar is the environment variable that holds the HMAC
+// key used to sign and verify settings export/import bundles
+// (see settings.SettingsBundle). There is no config-file equivalent yet:
+// the key is operator-managed secret material, not tunable application
+// config, so it is read directly from the environment rather than plumbed
+// through the rest of this package's config struct.
+const settingsSigningKeyEnvVar = "HYPERSPOT_SETTINGS_SIGNING_KEY"
+
+// GetSettingsSigningKey returns the server-side key used to sign and verify
+// settings export/import bundles. An empty string means bundle export and
+// import are disabled until the operator configures one.
+func GetSettingsSigningKey() string {
+	return os.Getenv(settingsSigningKeyEnvVar)
+}
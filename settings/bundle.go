@@ -0,0 +1,148 @@
+package settings
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/hypernetix/hyperspot/libs/auth"
+	"github.com/hypernetix/hyperspot/libs/config"
+	"github.com/hypernetix/hyperspot/libs/db"
+	"github.com/hypernetix/hyperspot/libs/errorx"
+)
+
+// bundleSchemaVersion is incremented whenever SettingsBundle's shape
+// changes in a way that breaks older importers.
+const bundleSchemaVersion = 1
+
+// SettingsBundle is a portable, signed snapshot of one scope's settings,
+// used to move preferences between HyperSpot instances (GET/POST
+// /settings/export and /settings/import).
+type SettingsBundle struct {
+	SchemaVersion int                    `json:"schema_version"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Scope         Scope                  `json:"scope"`
+	ScopeID       string                 `json:"scope_id"`
+	Settings      map[string]interface{} `json:"settings"`
+	Signature     string                 `json:"signature"`
+}
+
+// signingPayload returns the canonical bytes a bundle's HMAC is computed
+// over: everything except the signature itself.
+func (b SettingsBundle) signingPayload() ([]byte, error) {
+	unsigned := b
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// signingKey returns the server-side HMAC key used to sign and verify
+// bundles. An unconfigured key is an operator/deployment choice, not a
+// server fault, so it is surfaced as a 501 rather than a 500.
+func signingKey() ([]byte, errorx.Error) {
+	key := config.GetSettingsSigningKey()
+	if key == "" {
+		return nil, errorx.NewErrNotImplemented("settings export/import is not configured on this server")
+	}
+	return []byte(key), nil
+}
+
+// sign computes and sets b.Signature over the bundle's current contents.
+func (b *SettingsBundle) sign() errorx.Error {
+	key, errx := signingKey()
+	if errx != nil {
+		return errx
+	}
+
+	payload, err := b.signingPayload()
+	if err != nil {
+		return errorx.NewErrInternalServerError("failed to encode settings bundle: %s", err.Error())
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	b.Signature = hex.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+// verify reports whether b.Signature matches the bundle's contents.
+func (b SettingsBundle) verify() errorx.Error {
+	key, errx := signingKey()
+	if errx != nil {
+		return errx
+	}
+
+	payload, err := b.signingPayload()
+	if err != nil {
+		return errorx.NewErrInternalServerError("failed to encode settings bundle: %s", err.Error())
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(b.Signature)) {
+		return errorx.NewErrBadRequest("settings bundle signature is invalid")
+	}
+	return nil
+}
+
+// exportBundle snapshots and signs the caller's own user-scope settings.
+func exportBundle(ctx context.Context) (*SettingsBundle, errorx.Error) {
+	scopeID := userScopeID(auth.GetTenantID().String(), auth.GetUserID().String())
+
+	values, errx := listScope(db.DB(), ScopeUser, scopeID)
+	if errx != nil {
+		return nil, errx
+	}
+
+	bundle := &SettingsBundle{
+		SchemaVersion: bundleSchemaVersion,
+		Timestamp:     time.Now(),
+		Scope:         ScopeUser,
+		ScopeID:       scopeID,
+		Settings:      values,
+	}
+	if errx := bundle.sign(); errx != nil {
+		return nil, errx
+	}
+	return bundle, nil
+}
+
+// importBundle verifies bundle, checks schema compatibility, and applies its
+// settings to the caller's own user scope (regardless of which scope/ID it
+// was originally exported from). When dryRun is true it returns the diff
+// the import would make without persisting anything.
+func importBundle(ctx context.Context, bundle SettingsBundle, dryRun bool) (map[string]historyFieldDiff, errorx.Error) {
+	if errx := bundle.verify(); errx != nil {
+		return nil, errx
+	}
+	if bundle.SchemaVersion != bundleSchemaVersion {
+		return nil, errorx.NewErrBadRequest("unsupported settings bundle schema version %d", bundle.SchemaVersion)
+	}
+
+	scopeID := userScopeID(auth.GetTenantID().String(), auth.GetUserID().String())
+
+	diff := make(map[string]historyFieldDiff, len(bundle.Settings))
+	for key, value := range bundle.Settings {
+		if errx := validateSettingValue(ScopeUser, key, value); errx != nil {
+			return nil, errx
+		}
+		oldValue, _, errx := getValue(db.DB(), ScopeUser, scopeID, key)
+		if errx != nil {
+			return nil, errx
+		}
+		diff[key] = historyFieldDiff{Old: oldValue, New: value}
+	}
+
+	if dryRun {
+		return diff, nil
+	}
+
+	if _, _, _, errx := forceApplyScopeUpdate(ctx, ScopeUser, scopeID, bundle.Settings, sourceImport); errx != nil {
+		return nil, errx
+	}
+	return diff, nil
+}
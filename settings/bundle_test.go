@@ -0,0 +1,72 @@
+package settings
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hypernetix/hyperspot/libs/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportBundleRoundTrip(t *testing.T) {
+	t.Setenv("HYPERSPOT_SETTINGS_SIGNING_KEY", "bundle-test-key")
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+	scopeID := userScopeID(auth.GetTenantID().String(), auth.GetUserID().String())
+
+	require.NoError(t, setValue(ctx, ScopeUser, scopeID, "ui.theme", "dark"))
+
+	bundle, errx := exportBundle(ctx)
+	require.NoError(t, errx)
+	assert.Equal(t, "dark", bundle.Settings["ui.theme"])
+	assert.NotEmpty(t, bundle.Signature)
+
+	// Tampering with the payload after signing must fail verification.
+	tampered := *bundle
+	tampered.Settings = map[string]interface{}{"ui.theme": "light"}
+	errx = tampered.verify()
+	require.Error(t, errx, "tampered bundle should fail verification")
+
+	// A dry-run import reports the diff without persisting it.
+	diff, errx := importBundle(ctx, *bundle, true)
+	require.NoError(t, errx)
+	assert.Equal(t, "dark", diff["ui.theme"].New)
+
+	// A real import applies the bundle's settings.
+	require.NoError(t, setValue(ctx, ScopeUser, scopeID, "ui.theme", "light"))
+	diff, errx = importBundle(ctx, *bundle, false)
+	require.NoError(t, errx)
+	assert.Equal(t, "light", diff["ui.theme"].Old)
+	assert.Equal(t, "dark", diff["ui.theme"].New)
+
+	effective, errx := getEffective(ctx, "ui.theme")
+	require.NoError(t, errx)
+	assert.Equal(t, "dark", effective.Value)
+}
+
+func TestImportBundleRejectsUnsupportedSchemaVersion(t *testing.T) {
+	t.Setenv("HYPERSPOT_SETTINGS_SIGNING_KEY", "bundle-test-key")
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+	bundle, errx := exportBundle(ctx)
+	require.NoError(t, errx)
+
+	bundle.SchemaVersion = bundleSchemaVersion + 1
+	require.NoError(t, bundle.sign())
+
+	_, errx = importBundle(ctx, *bundle, false)
+	require.Error(t, errx, "import should reject an unsupported schema version")
+}
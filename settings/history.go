@@ -0,0 +1,141 @@
+package settings
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hypernetix/hyperspot/libs/auth"
+	"github.com/hypernetix/hyperspot/libs/db"
+	"github.com/hypernetix/hyperspot/libs/errorx"
+	"gorm.io/gorm"
+)
+
+// Sources recorded on SettingsHistory rows, identifying how a change was
+// made.
+const (
+	sourceAPI    = "api"
+	sourceRevert = "revert"
+	sourceImport = "import"
+)
+
+// historyFieldDiff is the old/new value pair for a single changed key,
+// stored JSON-encoded in SettingsHistory.Diff.
+type historyFieldDiff struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// SettingsHistory records a single committed settings change for audit and
+// revert purposes. One row covers the whole scope write that produced it
+// (every key touched by one applyScopeUpdate call), rather than one row per
+// key, so a revert can restore the write atomically.
+type SettingsHistory struct {
+	ID        uint      `json:"id" db:"id,primaryKey,autoIncrement"`
+	Scope     string    `json:"scope" db:"scope"`
+	ScopeID   string    `json:"scope_id" db:"scope_id"`
+	TenantID  string    `json:"tenant_id" db:"tenant_id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	ChangedAt time.Time `json:"changed_at" db:"changed_at"`
+	Actor     string    `json:"actor" db:"actor"`
+	Diff      string    `json:"diff" db:"diff"`
+	Source    string    `json:"source" db:"source"`
+	Version   int64     `json:"version" db:"version"`
+}
+
+func (SettingsHistory) TableName() string {
+	return "settings_history"
+}
+
+// recordHistory writes one SettingsHistory row for a committed scope
+// change, inside the same transaction as the settings write it describes,
+// and returns the created row so callers don't have to re-query for it.
+func recordHistory(tx *gorm.DB, scope Scope, scopeID string, diff map[string]historyFieldDiff, newVersion int64, source string) (*SettingsHistory, error) {
+	encoded, err := json.Marshal(diff)
+	if err != nil {
+		return nil, errorx.NewErrInternalServerError("failed to encode history diff: %s", err.Error())
+	}
+
+	row := SettingsHistory{
+		Scope:     string(scope),
+		ScopeID:   scopeID,
+		TenantID:  auth.GetTenantID().String(),
+		UserID:    auth.GetUserID().String(),
+		ChangedAt: time.Now(),
+		Actor:     auth.GetUserID().String(),
+		Diff:      string(encoded),
+		Source:    source,
+		Version:   newVersion,
+	}
+	if err := tx.Create(&row).Error; err != nil {
+		return nil, errorx.NewErrInternalServerError("failed to record settings history: %s", err.Error())
+	}
+	return &row, nil
+}
+
+// listHistory returns up to limit history rows for the caller's tenant,
+// older than before (by ID, descending), most recent first. before of 0
+// starts from the newest row. Scoping to the caller's tenant keeps one
+// tenant's audit trail from leaking another's.
+func listHistory(ctx context.Context, limit int, before uint) ([]SettingsHistory, errorx.Error) {
+	if limit <= 0 {
+		limit = 50
+	}
+
+	query := db.DB().Where("tenant_id = ?", auth.GetTenantID().String()).Order("id DESC").Limit(limit)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var rows []SettingsHistory
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, errorx.NewErrInternalServerError("%s", err.Error())
+	}
+	return rows, nil
+}
+
+// revertHistory re-applies the "old" side of a past change, as one new
+// forced write recorded with source "revert". Keys that were newly created
+// by the original change (Old == nil) are deleted instead, since there is
+// no prior value to restore.
+func revertHistory(ctx context.Context, id uint) (*SettingsHistory, errorx.Error) {
+	var row SettingsHistory
+	if err := db.DB().First(&row, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errorx.NewErrNotFound("settings history entry %d not found", id)
+		}
+		return nil, errorx.NewErrInternalServerError("%s", err.Error())
+	}
+	if row.TenantID != auth.GetTenantID().String() {
+		// Don't reveal that the ID belongs to another tenant.
+		return nil, errorx.NewErrNotFound("settings history entry %d not found", id)
+	}
+	if Scope(row.Scope) == ScopeUser && row.ScopeID != userScopeID(auth.GetTenantID().String(), auth.GetUserID().String()) {
+		// Same tenant, but a different user's change - don't reveal it exists.
+		return nil, errorx.NewErrNotFound("settings history entry %d not found", id)
+	}
+
+	var diff map[string]historyFieldDiff
+	if err := json.Unmarshal([]byte(row.Diff), &diff); err != nil {
+		return nil, errorx.NewErrInternalServerError("failed to decode history diff: %s", err.Error())
+	}
+
+	values := make(map[string]interface{}, len(diff))
+	var deleteKeys []string
+	for key, fieldDiff := range diff {
+		if fieldDiff.Old == nil {
+			deleteKeys = append(deleteKeys, key)
+			continue
+		}
+		values[key] = fieldDiff.Old
+	}
+	if len(values) == 0 && len(deleteKeys) == 0 {
+		return nil, errorx.NewErrBadRequest("settings history entry %d has nothing to revert", id)
+	}
+
+	_, _, reverted, errx := forceApplyScopeRevert(ctx, Scope(row.Scope), row.ScopeID, values, deleteKeys, sourceRevert)
+	if errx != nil {
+		return nil, errx
+	}
+	return reverted, nil
+}
@@ -0,0 +1,96 @@
+package settings
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyScopeUpdateRecordsHistory(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+
+	_, _, _, errx := applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "dark"}, "")
+	require.NoError(t, errx)
+
+	rows, errx := listHistory(ctx, 10, 0)
+	require.NoError(t, errx)
+	require.Len(t, rows, 1)
+	assert.Equal(t, sourceAPI, rows[0].Source)
+	assert.Equal(t, int64(1), rows[0].Version)
+}
+
+func TestRevertHistoryRestoresPriorValue(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+
+	_, _, _, errx := applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "dark"}, "")
+	require.NoError(t, errx)
+
+	_, _, _, errx = applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "light"}, formatETag(1))
+	require.NoError(t, errx)
+
+	rows, errx := listHistory(ctx, 10, 0)
+	require.NoError(t, errx)
+	require.Len(t, rows, 2)
+
+	// rows[0] is the most recent entry (dark -> light); revert it.
+	reverted, errx := revertHistory(ctx, rows[0].ID)
+	require.NoError(t, errx)
+	assert.Equal(t, sourceRevert, reverted.Source)
+
+	effective, errx := getEffective(ctx, "ui.theme")
+	require.NoError(t, errx)
+	assert.Equal(t, "dark", effective.Value)
+}
+
+func TestRevertHistoryNotFound(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	_, errx := revertHistory(context.Background(), 999)
+	require.Error(t, errx)
+}
+
+func TestRevertHistoryDeletesNewlyCreatedKey(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+
+	_, _, _, errx := applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "dark"}, "")
+	require.NoError(t, errx)
+
+	rows, errx := listHistory(ctx, 10, 0)
+	require.NoError(t, errx)
+	require.Len(t, rows, 1)
+
+	_, errx = revertHistory(ctx, rows[0].ID)
+	require.NoError(t, errx)
+
+	_, ok, errx := getValue(testDB, ScopeSystem, "", "ui.theme")
+	require.NoError(t, errx)
+	assert.False(t, ok, "reverting the creation of a key should delete it, not leave a stale value")
+}
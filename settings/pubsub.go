@@ -0,0 +1,104 @@
+package settings
+
+import (
+	"sync"
+
+	"github.com/hypernetix/hyperspot/libs/logging"
+)
+
+// subscriberBufferSize bounds how many undelivered events a single SSE
+// subscriber can queue before new events are dropped for it. A slow or
+// stalled client must not block writers or other subscribers.
+const subscriberBufferSize = 32
+
+// settingsEvent describes a single committed settings change, as delivered
+// over GET /settings/stream.
+type settingsEvent struct {
+	Scope   Scope       `json:"scope"`
+	ScopeID string      `json:"scope_id"`
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value"`
+	Version int64       `json:"version"`
+}
+
+// relevantTo reports whether the event should be delivered to a subscriber
+// watching the given tenant/user: system-scope changes reach everyone,
+// tenant-scope changes reach subscribers in that tenant, and user-scope
+// changes reach only that user.
+func (e settingsEvent) relevantTo(tenantID, userID string) bool {
+	switch e.Scope {
+	case ScopeSystem:
+		return true
+	case ScopeTenant:
+		return e.ScopeID == tenantID
+	case ScopeUser:
+		return e.ScopeID == userScopeID(tenantID, userID)
+	default:
+		return false
+	}
+}
+
+// subscriber is one live GET /settings/stream connection.
+type subscriber struct {
+	id       int64
+	tenantID string
+	userID   string
+	ch       chan settingsEvent
+}
+
+// broker is a small in-process pub/sub: updateSettings-style writes publish
+// here, and SSE handlers subscribe to receive the changes relevant to their
+// caller. There is one broker per process; it holds no state beyond the
+// current set of live subscribers.
+type broker struct {
+	mu          sync.Mutex
+	nextID      int64
+	subscribers map[int64]*subscriber
+}
+
+var settingsBroker = &broker{subscribers: map[int64]*subscriber{}}
+
+// subscribe registers a new subscriber for tenantID/userID and returns its
+// event channel plus an unsubscribe function the caller must invoke when
+// done (typically via defer).
+func (b *broker) subscribe(tenantID, userID string) (<-chan settingsEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	sub := &subscriber{
+		id:       b.nextID,
+		tenantID: tenantID,
+		userID:   userID,
+		ch:       make(chan settingsEvent, subscriberBufferSize),
+	}
+	b.subscribers[sub.id] = sub
+
+	return sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub.id]; ok {
+			delete(b.subscribers, sub.id)
+			close(sub.ch)
+		}
+	}
+}
+
+// publish delivers event to every subscriber it is relevant to. A
+// subscriber whose buffer is full has the event dropped with a warning
+// rather than blocking the writer.
+func (b *broker) publish(event settingsEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.subscribers {
+		if !event.relevantTo(sub.tenantID, sub.userID) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			logging.Warn("settings: dropping event for slow SSE subscriber (tenant=%s user=%s key=%s)", sub.tenantID, sub.userID, event.Key)
+		}
+	}
+}
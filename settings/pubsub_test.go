@@ -0,0 +1,51 @@
+package settings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerDeliversRelevantEvents(t *testing.T) {
+	b := &broker{subscribers: map[int64]*subscriber{}}
+
+	events, unsubscribe := b.subscribe("tenant-a", "user-1")
+	defer unsubscribe()
+
+	// System-scope events reach every subscriber.
+	b.publish(settingsEvent{Scope: ScopeSystem, Key: "ui.theme", Value: "dark", Version: 1})
+	select {
+	case e := <-events:
+		assert.Equal(t, "dark", e.Value)
+	case <-time.After(time.Second):
+		t.Fatal("expected system-scope event to be delivered")
+	}
+
+	// Tenant-scope events for a different tenant are filtered out.
+	b.publish(settingsEvent{Scope: ScopeTenant, ScopeID: "tenant-b", Key: "ui.theme", Value: "light", Version: 1})
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event for a different tenant: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// User-scope events for this exact user are delivered.
+	b.publish(settingsEvent{Scope: ScopeUser, ScopeID: userScopeID("tenant-a", "user-1"), Key: "ui.theme", Value: "solarized", Version: 2})
+	select {
+	case e := <-events:
+		assert.Equal(t, "solarized", e.Value)
+	case <-time.After(time.Second):
+		t.Fatal("expected user-scope event to be delivered")
+	}
+}
+
+func TestBrokerUnsubscribeClosesChannel(t *testing.T) {
+	b := &broker{subscribers: map[int64]*subscriber{}}
+	events, unsubscribe := b.subscribe("tenant-a", "user-1")
+	unsubscribe()
+
+	_, ok := <-events
+	require.False(t, ok, "channel should be closed after unsubscribe")
+}
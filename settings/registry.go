@@ -0,0 +1,92 @@
+package settings
+
+import (
+	"sync"
+
+	"github.com/hypernetix/hyperspot/libs/errorx"
+)
+
+// Scope identifies how broadly a setting applies. Narrower scopes override
+// broader ones when a value is resolved: user overrides tenant overrides
+// system.
+type Scope string
+
+const (
+	ScopeSystem Scope = "system"
+	ScopeTenant Scope = "tenant"
+	ScopeUser   Scope = "user"
+)
+
+// SettingSchema describes a setting that a module registers at init time.
+// It replaces the old approach of hardcoding fields directly on the
+// Settings struct: any module can now contribute a typed, validated,
+// scope-aware setting without touching this package.
+type SettingSchema struct {
+	// Key uniquely identifies the setting, e.g. "ui.theme".
+	Key string
+	// Scopes lists the scopes this setting may be stored/read at. GET/POST
+	// handlers reject writes to scopes not listed here.
+	Scopes []Scope
+	// Default is the value returned when no row exists at any applicable
+	// scope.
+	Default interface{}
+	// Validate, if set, is called with the decoded value before it is
+	// persisted. Returning an error aborts the write.
+	Validate func(value interface{}) errorx.Error
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]SettingSchema{}
+)
+
+// Register adds a setting schema to the registry. It is meant to be called
+// from a module's InitModule, mirroring how core.RegisterModule is called
+// once per module at startup. Registering the same key twice is an error.
+func Register(schema SettingSchema) error {
+	if schema.Key == "" {
+		return errorx.NewErrBadRequest("setting schema key must not be empty")
+	}
+	if len(schema.Scopes) == 0 {
+		return errorx.NewErrBadRequest("setting schema %q must allow at least one scope", schema.Key)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[schema.Key]; exists {
+		return errorx.NewErrBadRequest("setting schema %q is already registered", schema.Key)
+	}
+	registry[schema.Key] = schema
+	return nil
+}
+
+// getSchema returns the registered schema for key, or false if none exists.
+func getSchema(key string) (SettingSchema, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	schema, ok := registry[key]
+	return schema, ok
+}
+
+// allSchemas returns a snapshot of every registered schema.
+func allSchemas() map[string]SettingSchema {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	out := make(map[string]SettingSchema, len(registry))
+	for k, v := range registry {
+		out[k] = v
+	}
+	return out
+}
+
+// scopeAllowed reports whether schema can be stored at scope.
+func (s SettingSchema) scopeAllowed(scope Scope) bool {
+	for _, allowed := range s.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,9 @@ package settings
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 
-	"github.com/google/uuid"
 	"github.com/hypernetix/hyperspot/libs/auth"
 	"github.com/hypernetix/hyperspot/libs/core"
 	"github.com/hypernetix/hyperspot/libs/db"
@@ -15,63 +16,294 @@ import (
 
 var mu utils.DebugMutex
 
-// Setting represents user settings
-type Settings struct {
-	Theme    string    `json:"theme" db:"theme" default:""`
-	Language string    `json:"language" db:"language" default:""`
-	UserID   uuid.UUID `json:"-" db:"user_id,primaryKey"`
-	TenantID uuid.UUID `json:"-" db:"tenant_id,primaryKey"`
+// SettingRecord is the generic, per-scope row backing every registered
+// setting. Rows are keyed by (scope, scope_id, key) instead of one column
+// per field, so new settings can be registered without a schema migration.
+//
+// ScopeID disambiguates rows within a scope: it is empty for ScopeSystem,
+// the tenant ID for ScopeTenant, and "<tenant_id>/<user_id>" for ScopeUser
+// so that the same user ID in different tenants doesn't collide.
+type SettingRecord struct {
+	Scope   string `json:"-" db:"scope,primaryKey"`
+	ScopeID string `json:"-" db:"scope_id,primaryKey"`
+	Key     string `json:"-" db:"key,primaryKey"`
+	Value   string `json:"-" db:"value"`
 }
 
-func getSettings(ctx context.Context) (*Settings, errorx.Error) {
-	var settings Settings
-	if err := db.DB().Where("tenant_id = ? AND user_id = ?", auth.GetTenantID(), auth.GetUserID()).First(&settings).Error; err != nil {
+func (SettingRecord) TableName() string {
+	return "settings_values"
+}
+
+// userScopeID builds the ScopeID used for ScopeUser rows belonging to the
+// given tenant/user pair.
+func userScopeID(tenantID, userID string) string {
+	return tenantID + "/" + userID
+}
+
+// legacySettingsRow mirrors the pre-registry Settings struct's columns, one
+// row per (tenant, user), back when "theme" and "language" were the only
+// two settings that existed. It exists solely to read out of that table's
+// "settings" name during backfillLegacySettings; SettingRecord now owns the
+// settings_values table instead so the two schemas can't collide.
+type legacySettingsRow struct {
+	Theme    string `db:"theme"`
+	Language string `db:"language"`
+	UserID   string `db:"user_id"`
+	TenantID string `db:"tenant_id"`
+}
+
+func (legacySettingsRow) TableName() string {
+	return "settings"
+}
+
+var backfillLegacySettingsOnce sync.Once
+
+// backfillLegacySettings copies rows left behind by the pre-registry
+// Settings struct (one "theme"/"language" row per tenant/user, table
+// "settings") into the new per-key settings_values rows, so upgrading
+// deployments don't silently lose existing preferences now that the two
+// schemas live in separate tables. It is idempotent: setValueLocked's
+// create-or-update logic means running it twice just re-applies the same
+// values, and it skips users who already have a "ui.theme"/"ui.language"
+// row of their own. It runs once, lazily, the first time the API routes
+// are wired up.
+func backfillLegacySettings() {
+	if !db.DB().Migrator().HasTable("settings") {
+		return
+	}
+
+	var rows []legacySettingsRow
+	if err := db.DB().Find(&rows).Error; err != nil {
+		logging.Error("settings: failed to read legacy settings table: %s", err.Error())
+		return
+	}
+
+	for _, row := range rows {
+		if row.TenantID == "" || row.UserID == "" {
+			continue
+		}
+		scopeID := userScopeID(row.TenantID, row.UserID)
+
+		legacy := map[string]string{"ui.theme": row.Theme, "ui.language": row.Language}
+		for key, value := range legacy {
+			if value == "" {
+				continue
+			}
+			if _, ok, errx := getValue(db.DB(), ScopeUser, scopeID, key); errx == nil && ok {
+				continue
+			}
+			if errx := setValue(context.Background(), ScopeUser, scopeID, key, value); errx != nil {
+				logging.Error("settings: failed to backfill legacy %q for %s/%s: %s", key, row.TenantID, row.UserID, errx.Error())
+			}
+		}
+	}
+}
+
+// callerScopeIDs returns the (scope, scopeID) pairs to look up for the
+// calling tenant/user, narrowest first, as resolved from auth context.
+func callerScopeIDs(ctx context.Context) []struct {
+	Scope   Scope
+	ScopeID string
+} {
+	tenantID := auth.GetTenantID().String()
+	userID := auth.GetUserID().String()
+	return []struct {
+		Scope   Scope
+		ScopeID string
+	}{
+		{ScopeUser, userScopeID(tenantID, userID)},
+		{ScopeTenant, tenantID},
+		{ScopeSystem, ""},
+	}
+}
+
+// getValue reads the raw stored value for (scope, scopeID, key) using exec
+// (either db.DB() or a transaction). The bool return is false if no row
+// exists yet.
+func getValue(exec *gorm.DB, scope Scope, scopeID, key string) (interface{}, bool, errorx.Error) {
+	var record SettingRecord
+	err := exec.Where("scope = ? AND scope_id = ? AND key = ?", string(scope), scopeID, key).First(&record).Error
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			settings.UserID = auth.GetUserID()
-			settings.TenantID = auth.GetTenantID()
-			return &settings, nil
+			return nil, false, nil
 		}
-		return nil, errorx.NewErrInternalServerError("%s", err.Error())
+		return nil, false, errorx.NewErrInternalServerError("%s", err.Error())
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(record.Value), &value); err != nil {
+		return nil, false, errorx.NewErrInternalServerError("failed to decode stored value for %q: %s", key, err.Error())
 	}
-	return &settings, nil
+	return value, true, nil
 }
 
-func updateSettings(ctx context.Context, settings *Settings) errorx.Error {
-	settings.UserID = auth.GetUserID()
-	settings.TenantID = auth.GetTenantID()
+// listScope returns every stored key/value pair for the given scope+scopeID.
+func listScope(exec *gorm.DB, scope Scope, scopeID string) (map[string]interface{}, errorx.Error) {
+	var records []SettingRecord
+	if err := exec.Where("scope = ? AND scope_id = ?", string(scope), scopeID).Find(&records).Error; err != nil {
+		return nil, errorx.NewErrInternalServerError("%s", err.Error())
+	}
 
-	logging.Debug("Updating settings for user %s in tenant %s", settings.UserID, settings.TenantID)
+	out := make(map[string]interface{}, len(records))
+	for _, record := range records {
+		var value interface{}
+		if err := json.Unmarshal([]byte(record.Value), &value); err != nil {
+			return nil, errorx.NewErrInternalServerError("failed to decode stored value for %q: %s", record.Key, err.Error())
+		}
+		out[record.Key] = value
+	}
+	return out, nil
+}
 
+// setValue validates and persists value for (scope, scopeID, key), creating
+// or updating the row as needed. It does not bump the scope's version; it
+// is used internally (e.g. in tests) where CAS semantics don't apply. API
+// writes go through applyScopeUpdate instead.
+func setValue(ctx context.Context, scope Scope, scopeID, key string, value interface{}) errorx.Error {
 	mu.Lock()
 	defer mu.Unlock()
+	return setValueLocked(db.DB(), ctx, scope, scopeID, key, value)
+}
+
+// validateSettingValue checks key against the schema registry: that it is
+// registered, that it may be set at scope, and that it passes the schema's
+// own Validate func if it has one. It is the shared gate in front of every
+// settings write, including ones (like a bundle import dry-run) that never
+// reach setValueLocked.
+func validateSettingValue(scope Scope, key string, value interface{}) errorx.Error {
+	schema, ok := getSchema(key)
+	if !ok {
+		return errorx.NewErrBadRequest("unknown setting %q", key)
+	}
+	if !schema.scopeAllowed(scope) {
+		return errorx.NewErrBadRequest("setting %q may not be set at %s scope", key, scope)
+	}
+	if schema.Validate != nil {
+		if errx := schema.Validate(value); errx != nil {
+			return errx
+		}
+	}
+	return nil
+}
+
+// deleteValueLocked removes the row for (scope, scopeID, key) against exec,
+// if any. It is the counterpart to setValueLocked used when a revert needs
+// to undo a key's creation rather than restore a prior value. Callers must
+// hold mu.
+func deleteValueLocked(exec *gorm.DB, scope Scope, scopeID, key string) errorx.Error {
+	if err := exec.Where("scope = ? AND scope_id = ? AND key = ?", string(scope), scopeID, key).Delete(&SettingRecord{}).Error; err != nil {
+		return errorx.NewErrInternalServerError("failed to delete setting %q: %s", key, err.Error())
+	}
+	return nil
+}
+
+// setValueLocked is the lock-free core of setValue, run against exec (either
+// db.DB() or a transaction). Callers must hold mu.
+func setValueLocked(exec *gorm.DB, ctx context.Context, scope Scope, scopeID, key string, value interface{}) errorx.Error {
+	if errx := validateSettingValue(scope, key, value); errx != nil {
+		return errx
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return errorx.NewErrBadRequest("invalid value for %q: %s", key, err.Error())
+	}
+
+	logging.Debug("Setting %q at scope %s/%s", key, scope, scopeID)
+
+	record := SettingRecord{Scope: string(scope), ScopeID: scopeID, Key: key, Value: string(encoded)}
 
-	// Check if the record exists
 	var count int64
-	if err := db.DB().Model(&Settings{}).Where("user_id = ? AND tenant_id = ?", settings.UserID, settings.TenantID).Count(&count).Error; err != nil {
+	if err := exec.Model(&SettingRecord{}).Where("scope = ? AND scope_id = ? AND key = ?", string(scope), scopeID, key).Count(&count).Error; err != nil {
 		return errorx.NewErrInternalServerError("%s", err.Error())
 	}
 
-	// If record doesn't exist, create it; otherwise, update it
 	if count == 0 {
-		if err := db.DB().Create(settings).Error; err != nil {
-			return errorx.NewErrInternalServerError("Failed to create settings: %s", err.Error())
+		if err := exec.Create(&record).Error; err != nil {
+			return errorx.NewErrInternalServerError("failed to create setting %q: %s", key, err.Error())
 		}
 	} else {
-		if err := db.DB().Where("user_id = ? AND tenant_id = ?", settings.UserID, settings.TenantID).Updates(settings).Error; err != nil {
-			return errorx.NewErrInternalServerError("Failed to update settings: %s", err.Error())
+		if err := exec.Where("scope = ? AND scope_id = ? AND key = ?", string(scope), scopeID, key).Updates(&record).Error; err != nil {
+			return errorx.NewErrInternalServerError("failed to update setting %q: %s", key, err.Error())
 		}
 	}
 	return nil
 }
 
+// EffectiveValue is a resolved setting value along with the scope it came
+// from, as returned by GET /settings/effective.
+type EffectiveValue struct {
+	Value interface{} `json:"value"`
+	Scope Scope       `json:"scope"`
+}
+
+// getEffective resolves key by walking system -> tenant -> user and keeping
+// the narrowest match, falling back to the schema default if nothing is
+// stored anywhere.
+func getEffective(ctx context.Context, key string) (*EffectiveValue, errorx.Error) {
+	schema, ok := getSchema(key)
+	if !ok {
+		return nil, errorx.NewErrBadRequest("unknown setting %q", key)
+	}
+
+	best := &EffectiveValue{Value: schema.Default, Scope: ScopeSystem}
+	for _, candidate := range callerScopeIDs(ctx) {
+		if !schema.scopeAllowed(candidate.Scope) {
+			continue
+		}
+		value, found, errx := getValue(db.DB(), candidate.Scope, candidate.ScopeID, key)
+		if errx != nil {
+			return nil, errx
+		}
+		if found {
+			return &EffectiveValue{Value: value, Scope: candidate.Scope}, nil
+		}
+	}
+	return best, nil
+}
+
+// getAllEffective resolves every registered setting for the calling
+// tenant/user.
+func getAllEffective(ctx context.Context) (map[string]EffectiveValue, errorx.Error) {
+	out := make(map[string]EffectiveValue)
+	for key := range allSchemas() {
+		value, errx := getEffective(ctx, key)
+		if errx != nil {
+			return nil, errx
+		}
+		out[key] = *value
+	}
+	return out, nil
+}
+
 // InitModule initializes the setting module
 func InitModule() {
 	core.RegisterModule(&core.Module{
 		Name: "settings",
 		Migrations: []interface{}{
-			&Settings{},
+			&SettingRecord{},
+			&ScopeVersion{},
+			&SettingsHistory{},
 		},
 		InitAPIRoutes: registerSettingsAPIRoutes,
 		InitMain:      nil, // No background jobs for settings
 	})
+
+	registerBuiltinSchemas()
+}
+
+// registerBuiltinSchemas registers the settings this package used to hold as
+// hardcoded struct fields (UI theme/language), now as ordinary registered
+// schemas like any other module would define.
+func registerBuiltinSchemas() {
+	_ = Register(SettingSchema{
+		Key:     "ui.theme",
+		Scopes:  []Scope{ScopeSystem, ScopeTenant, ScopeUser},
+		Default: "",
+	})
+	_ = Register(SettingSchema{
+		Key:     "ui.language",
+		Scopes:  []Scope{ScopeSystem, ScopeTenant, ScopeUser},
+		Default: "",
+	})
 }
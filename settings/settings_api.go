@@ -3,106 +3,384 @@ package settings
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/sse"
+	"github.com/hypernetix/hyperspot/libs/auth"
 	"github.com/hypernetix/hyperspot/libs/config"
+	"github.com/hypernetix/hyperspot/libs/db"
+	"github.com/hypernetix/hyperspot/libs/errorx"
 )
 
-type SettingsAPIResponse struct {
-	Body Settings `json:"body"`
+// streamHeartbeatInterval is how often GET /settings/stream sends a
+// heartbeat event to keep the connection alive through idle proxies.
+const streamHeartbeatInterval = 30 * time.Second
+
+// heartbeatEvent is sent periodically on GET /settings/stream so
+// intermediate proxies don't time out an otherwise idle connection.
+type heartbeatEvent struct{}
+
+// SettingsMapResponse carries a flat key -> value map, used by the
+// per-scope GET/POST endpoints. ETag reflects the scope's current version
+// for use in a subsequent If-Match write.
+type SettingsMapResponse struct {
+	ETag string                 `header:"ETag"`
+	Body map[string]interface{} `json:"body"`
+}
+
+// EffectiveSettingsResponse carries resolved key -> (value, scope) pairs,
+// returned by GET /settings/effective.
+type EffectiveSettingsResponse struct {
+	Body map[string]EffectiveValue `json:"body"`
 }
 
-// getSettingHandler retrieves settings for a user and tenant
-func getSettingHandler(ctx context.Context, input *struct{}) (*SettingsAPIResponse, error) {
-	settings, err := getSettings(ctx)
-	if err != nil {
-		return nil, err
+// scopeWriteInput is the input of the system-scope write endpoint: a body of
+// key/value pairs to set, guarded by an optional If-Match version. The tenant
+// and user write endpoints take the same fields plus a path ID.
+type scopeWriteInput struct {
+	IfMatch string                 `header:"If-Match"`
+	Body    map[string]interface{} `body:""`
+}
+
+// getSystemSettingsHandler returns every stored system-scope setting.
+func getSystemSettingsHandler(ctx context.Context, input *struct{}) (*SettingsMapResponse, error) {
+	values, errx := listScope(db.DB(), ScopeSystem, "")
+	if errx != nil {
+		return nil, errx
+	}
+	version, errx := getScopeVersion(ScopeSystem, "")
+	if errx != nil {
+		return nil, errx
+	}
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
+
+// updateSystemSettingsHandler writes system-scope settings, enforcing the
+// If-Match version against concurrent writers. System scope has no owning
+// tenant or user, so it is gated on the admin role alone rather than a
+// caller-identity comparison.
+func updateSystemSettingsHandler(ctx context.Context, input *scopeWriteInput) (*SettingsMapResponse, error) {
+	if !auth.IsAdmin() {
+		return nil, errorx.NewErrForbidden("only admins may write system-scope settings")
+	}
+	version, values, _, errx := applyScopeUpdate(ctx, ScopeSystem, "", input.Body, input.IfMatch)
+	if errx != nil {
+		return nil, errx
 	}
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
 
-	return &SettingsAPIResponse{
-		Body: *settings,
-	}, nil
+type tenantScopeInput struct {
+	ID string `path:"id"`
 }
 
-// updateSettingHandler updates settings for a user and tenant
-func updateSettingHandler(ctx context.Context, input *struct {
-	Body struct {
-		Theme    string `json:"theme"`
-		Language string `json:"language"`
-	} `body:""`
-}) (*SettingsAPIResponse, error) {
-	settings, errx := getSettings(ctx)
+// getTenantSettingsHandler returns stored settings for the given tenant.
+// Only the caller's own tenant, or an admin acting on another tenant's
+// behalf, may be read this way.
+func getTenantSettingsHandler(ctx context.Context, input *tenantScopeInput) (*SettingsMapResponse, error) {
+	if input.ID != auth.GetTenantID().String() && !auth.IsAdmin() {
+		return nil, errorx.NewErrForbidden("not authorized to read settings for tenant %s", input.ID)
+	}
+	values, errx := listScope(db.DB(), ScopeTenant, input.ID)
 	if errx != nil {
 		return nil, errx
 	}
+	version, errx := getScopeVersion(ScopeTenant, input.ID)
+	if errx != nil {
+		return nil, errx
+	}
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
 
-	settings.Theme = input.Body.Theme
-	settings.Language = input.Body.Language
+type updateTenantScopeInput struct {
+	ID      string                 `path:"id"`
+	IfMatch string                 `header:"If-Match"`
+	Body    map[string]interface{} `body:""`
+}
 
-	if errx := updateSettings(ctx, settings); errx != nil {
+// updateTenantSettingsHandler writes settings for the given tenant, enforcing
+// the If-Match version against concurrent writers. Only the caller's own
+// tenant, or an admin acting on another tenant's behalf, may be written
+// this way.
+func updateTenantSettingsHandler(ctx context.Context, input *updateTenantScopeInput) (*SettingsMapResponse, error) {
+	if input.ID != auth.GetTenantID().String() && !auth.IsAdmin() {
+		return nil, errorx.NewErrForbidden("not authorized to write settings for tenant %s", input.ID)
+	}
+	version, values, _, errx := applyScopeUpdate(ctx, ScopeTenant, input.ID, input.Body, input.IfMatch)
+	if errx != nil {
 		return nil, errx
 	}
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
 
-	return &SettingsAPIResponse{
-		Body: *settings,
-	}, nil
+type userScopeInput struct {
+	ID string `path:"id"`
 }
 
-// patchSettingHandler partially updates settings for a user and tenant
-func patchSettingHandler(ctx context.Context, input *struct {
-	Body struct {
-		Theme    *string `json:"theme,omitempty"`
-		Language *string `json:"language,omitempty"`
-	} `body:""`
-}) (*SettingsAPIResponse, error) {
-	settings, errx := getSettings(ctx)
+// getUserSettingsHandler returns stored settings for the given user within
+// the caller's tenant.
+func getUserSettingsHandler(ctx context.Context, input *userScopeInput) (*SettingsMapResponse, error) {
+	scopeID := userScopeID(auth.GetTenantID().String(), input.ID)
+	values, errx := listScope(db.DB(), ScopeUser, scopeID)
+	if errx != nil {
+		return nil, errx
+	}
+	version, errx := getScopeVersion(ScopeUser, scopeID)
 	if errx != nil {
 		return nil, errx
 	}
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
+
+type updateUserScopeInput struct {
+	ID      string                 `path:"id"`
+	IfMatch string                 `header:"If-Match"`
+	Body    map[string]interface{} `body:""`
+}
 
-	// Only update fields that are provided in the request
-	if input.Body.Theme != nil {
-		settings.Theme = *input.Body.Theme
+// updateUserSettingsHandler writes settings for the given user within the
+// caller's tenant, enforcing the If-Match version against concurrent
+// writers.
+func updateUserSettingsHandler(ctx context.Context, input *updateUserScopeInput) (*SettingsMapResponse, error) {
+	scopeID := userScopeID(auth.GetTenantID().String(), input.ID)
+	version, values, _, errx := applyScopeUpdate(ctx, ScopeUser, scopeID, input.Body, input.IfMatch)
+	if errx != nil {
+		return nil, errx
 	}
-	if input.Body.Language != nil {
-		settings.Language = *input.Body.Language
+	return &SettingsMapResponse{ETag: formatETag(version), Body: values}, nil
+}
+
+// getEffectiveSettingsHandler returns every registered setting resolved for
+// the calling tenant/user, walking system -> tenant -> user.
+func getEffectiveSettingsHandler(ctx context.Context, input *struct{}) (*EffectiveSettingsResponse, error) {
+	values, errx := getAllEffective(ctx)
+	if errx != nil {
+		return nil, errx
+	}
+	return &EffectiveSettingsResponse{Body: values}, nil
+}
+
+// streamSettingsHandler upgrades to Server-Sent Events and pushes a
+// settingsEvent every time a committed write is relevant to the caller's
+// (tenant_id, user_id), so the web UI can reflect edits made from another
+// tab or the CLI without polling.
+func streamSettingsHandler(ctx context.Context, input *struct{}, send sse.Sender) error {
+	tenantID := auth.GetTenantID().String()
+	userID := auth.GetUserID().String()
+
+	events, unsubscribe := settingsBroker.subscribe(tenantID, userID)
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := send.Data(event); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := send.Data(heartbeatEvent{}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// HistoryResponse carries a page of settings history entries.
+type HistoryResponse struct {
+	Body []SettingsHistory `json:"body"`
+}
+
+type historyListInput struct {
+	Limit  int  `query:"limit"`
+	Before uint `query:"before"`
+}
+
+// getHistoryHandler returns a page of settings history entries, most recent
+// first.
+func getHistoryHandler(ctx context.Context, input *historyListInput) (*HistoryResponse, error) {
+	rows, errx := listHistory(ctx, input.Limit, input.Before)
+	if errx != nil {
+		return nil, errx
+	}
+	return &HistoryResponse{Body: rows}, nil
+}
+
+type revertHistoryInput struct {
+	ID uint `path:"id"`
+}
+
+// HistoryEntryResponse carries a single settings history entry.
+type HistoryEntryResponse struct {
+	Body SettingsHistory `json:"body"`
+}
+
+// revertHistoryHandler atomically re-applies the prior values captured in a
+// past history entry, recording the revert itself as a new history entry.
+func revertHistoryHandler(ctx context.Context, input *revertHistoryInput) (*HistoryEntryResponse, error) {
+	reverted, errx := revertHistory(ctx, input.ID)
+	if errx != nil {
+		return nil, errx
 	}
+	return &HistoryEntryResponse{Body: *reverted}, nil
+}
+
+// BundleResponse carries a signed settings bundle for export.
+type BundleResponse struct {
+	Body SettingsBundle `json:"body"`
+}
 
-	if errx := updateSettings(ctx, settings); errx != nil {
+// getExportSettingsHandler returns a signed, portable bundle of the
+// caller's own settings.
+func getExportSettingsHandler(ctx context.Context, input *struct{}) (*BundleResponse, error) {
+	bundle, errx := exportBundle(ctx)
+	if errx != nil {
 		return nil, errx
 	}
+	return &BundleResponse{Body: *bundle}, nil
+}
+
+type importSettingsInput struct {
+	DryRun bool           `query:"dry_run"`
+	Body   SettingsBundle `body:""`
+}
 
-	return &SettingsAPIResponse{
-		Body: *settings,
-	}, nil
+// ImportDiffResponse carries the per-key old/new diff an import applied (or
+// would apply, for a dry run).
+type ImportDiffResponse struct {
+	Body map[string]historyFieldDiff `json:"body"`
+}
+
+// postImportSettingsHandler validates and applies a previously exported
+// settings bundle, or just returns the diff it would make when dry_run=true.
+func postImportSettingsHandler(ctx context.Context, input *importSettingsInput) (*ImportDiffResponse, error) {
+	diff, errx := importBundle(ctx, input.Body, input.DryRun)
+	if errx != nil {
+		return nil, errx
+	}
+	return &ImportDiffResponse{Body: diff}, nil
 }
 
 // registerSettingAPIRoutes registers the setting API routes
 func registerSettingsAPIRoutes(api huma.API) {
+	backfillLegacySettingsOnce.Do(backfillLegacySettings)
+	backfillScopeVersionsOnce.Do(backfillScopeVersions)
+
 	huma.Register(api, huma.Operation{
-		OperationID:     "get-settings",
+		OperationID:     "get-system-settings",
 		Method:          http.MethodGet,
 		BodyReadTimeout: config.GetServerTimeout(),
-		Path:            "/settings",
-		Summary:         "Get user settings",
+		Path:            "/settings/system",
+		Summary:         "Get system-scope settings",
 		Tags:            []string{"Settings"},
-	}, getSettingHandler)
+	}, getSystemSettingsHandler)
 
 	huma.Register(api, huma.Operation{
-		OperationID:     "update-settings",
+		OperationID:     "update-system-settings",
 		Method:          http.MethodPost,
 		BodyReadTimeout: config.GetServerTimeout(),
-		Path:            "/settings",
-		Summary:         "Update user settings",
+		Path:            "/settings/system",
+		Summary:         "Update system-scope settings",
+		Tags:            []string{"Settings"},
+	}, updateSystemSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "get-tenant-settings",
+		Method:          http.MethodGet,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/tenant/{id}",
+		Summary:         "Get tenant-scope settings",
 		Tags:            []string{"Settings"},
-	}, updateSettingHandler)
+	}, getTenantSettingsHandler)
 
 	huma.Register(api, huma.Operation{
-		OperationID:     "patch-settings",
-		Method:          http.MethodPatch,
+		OperationID:     "update-tenant-settings",
+		Method:          http.MethodPost,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/tenant/{id}",
+		Summary:         "Update tenant-scope settings",
+		Tags:            []string{"Settings"},
+	}, updateTenantSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "get-user-settings",
+		Method:          http.MethodGet,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/user/{id}",
+		Summary:         "Get user-scope settings",
+		Tags:            []string{"Settings"},
+	}, getUserSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "update-user-settings",
+		Method:          http.MethodPost,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/user/{id}",
+		Summary:         "Update user-scope settings",
+		Tags:            []string{"Settings"},
+	}, updateUserSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "get-effective-settings",
+		Method:          http.MethodGet,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/effective",
+		Summary:         "Get settings resolved across system, tenant, and user scope",
+		Tags:            []string{"Settings"},
+	}, getEffectiveSettingsHandler)
+
+	sse.Register(api, huma.Operation{
+		OperationID: "stream-settings",
+		Method:      http.MethodGet,
+		Path:        "/settings/stream",
+		Summary:     "Stream live settings changes for the caller's tenant/user",
+		Tags:        []string{"Settings"},
+	}, map[string]any{
+		"settings-changed": settingsEvent{},
+		"heartbeat":        heartbeatEvent{},
+	}, streamSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "get-settings-history",
+		Method:          http.MethodGet,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/history",
+		Summary:         "Get paginated settings change history",
+		Tags:            []string{"Settings"},
+	}, getHistoryHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "revert-settings-history",
+		Method:          http.MethodPost,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/history/{id}/revert",
+		Summary:         "Revert settings to a prior history entry",
+		Tags:            []string{"Settings"},
+	}, revertHistoryHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "export-settings",
+		Method:          http.MethodGet,
+		BodyReadTimeout: config.GetServerTimeout(),
+		Path:            "/settings/export",
+		Summary:         "Export the caller's settings as a signed, portable bundle",
+		Tags:            []string{"Settings"},
+	}, getExportSettingsHandler)
+
+	huma.Register(api, huma.Operation{
+		OperationID:     "import-settings",
+		Method:          http.MethodPost,
 		BodyReadTimeout: config.GetServerTimeout(),
-		Path:            "/settings",
-		Summary:         "Partially update user settings",
+		Path:            "/settings/import",
+		Summary:         "Import a previously exported settings bundle",
 		Tags:            []string{"Settings"},
-	}, patchSettingHandler)
+	}, postImportSettingsHandler)
 }
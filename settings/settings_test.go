@@ -11,80 +11,114 @@ import (
 	"gorm.io/gorm"
 )
 
-// setupTestDB initializes an in-memory SQLite database and auto-migrates the Settings schema.
+// setupTestDB initializes an in-memory SQLite database and auto-migrates the
+// settings schema.
 func setupTestDB(t *testing.T) *gorm.DB {
 	t.Helper()
 	testDB, err := db.InitInMemorySQLite(nil)
 	require.NoError(t, err, "Failed to connect to test DB")
 	db.SetDB(testDB)
-	err = db.SafeAutoMigrate(testDB, &Settings{})
+	err = db.SafeAutoMigrate(testDB, &SettingRecord{}, &ScopeVersion{}, &SettingsHistory{})
 	require.NoError(t, err, "Failed to migrate test database")
 	return testDB
 }
 
-// TestWriteAndReadSettings tests writing a setting to the database and reading it back
-func TestWriteAndReadSettings(t *testing.T) {
-	// Setup test database
+// resetRegistry clears schemas registered by other tests/packages and
+// re-registers the built-in ones, so each test starts from a known state.
+func resetRegistry(t *testing.T) {
+	t.Helper()
+	registryMu.Lock()
+	registry = map[string]SettingSchema{}
+	registryMu.Unlock()
+	registerBuiltinSchemas()
+}
+
+func TestWriteAndReadUserSetting(t *testing.T) {
 	testDB := setupTestDB(t)
 	defer func() {
 		sqlDB, _ := testDB.DB()
 		sqlDB.Close()
 	}()
+	resetRegistry(t)
 
-	// Create a context
 	ctx := context.Background()
+	scopeID := userScopeID(auth.GetTenantID().String(), auth.GetUserID().String())
+
+	// No value stored yet: effective value falls back to the schema default.
+	effective, errx := getEffective(ctx, "ui.theme")
+	require.NoError(t, errx, "Failed to get initial effective setting")
+	assert.Equal(t, "", effective.Value)
+	assert.Equal(t, ScopeSystem, effective.Scope)
+
+	errx = setValue(ctx, ScopeUser, scopeID, "ui.theme", "dark")
+	require.NoError(t, errx, "Failed to set user setting")
+
+	effective, errx = getEffective(ctx, "ui.theme")
+	require.NoError(t, errx, "Failed to get effective setting after write")
+	assert.Equal(t, "dark", effective.Value)
+	assert.Equal(t, ScopeUser, effective.Scope)
+}
+
+func TestEffectiveSettingWalksScopes(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+	tenantID := auth.GetTenantID().String()
+
+	errx := setValue(ctx, ScopeSystem, "", "ui.language", "en")
+	require.NoError(t, errx, "Failed to set system setting")
+
+	effective, errx := getEffective(ctx, "ui.language")
+	require.NoError(t, errx)
+	assert.Equal(t, "en", effective.Value)
+	assert.Equal(t, ScopeSystem, effective.Scope)
+
+	errx = setValue(ctx, ScopeTenant, tenantID, "ui.language", "fr")
+	require.NoError(t, errx, "Failed to set tenant setting")
+
+	effective, errx = getEffective(ctx, "ui.language")
+	require.NoError(t, errx)
+	assert.Equal(t, "fr", effective.Value, "tenant-scope value should override system-scope")
+	assert.Equal(t, ScopeTenant, effective.Scope)
+}
+
+func TestSetValueRejectsUnknownKey(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	errx := setValue(context.Background(), ScopeSystem, "", "does.not.exist", "value")
+	require.Error(t, errx)
+}
+
+func TestSetValueRejectsDisallowedScope(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	require.NoError(t, Register(SettingSchema{
+		Key:     "test.system-only",
+		Scopes:  []Scope{ScopeSystem},
+		Default: "",
+	}))
+
+	errx := setValue(context.Background(), ScopeUser, "some-scope-id", "test.system-only", "x")
+	require.Error(t, errx, "setting a system-only key at user scope should fail")
+}
 
-	// Test data
-	theme := "dark"
-	language := "fr"
-
-	// 1. First, verify no settings exist yet
-	initialSettings, err := getSettings(ctx)
-	require.NoError(t, err, "Failed to get initial settings")
-	assert.Equal(t, "", initialSettings.Theme, "Theme should be empty initially")
-	assert.Equal(t, "", initialSettings.Language, "Language should be empty initially")
-	assert.Equal(t, auth.GetUserID(), initialSettings.UserID, "User ID should match")
-	assert.Equal(t, auth.GetTenantID(), initialSettings.TenantID, "Tenant ID should match")
-
-	// 2. Update settings
-	initialSettings.Theme = theme
-	initialSettings.Language = language
-
-	err = updateSettings(ctx, initialSettings)
-	require.NoError(t, err, "Failed to update settings")
-
-	// 3. Read settings back and verify they match
-	updatedSettings, err := getSettings(ctx)
-	require.NoError(t, err, "Failed to get updated settings")
-	assert.Equal(t, theme, updatedSettings.Theme, "Theme should match what was set")
-	assert.Equal(t, language, updatedSettings.Language, "Language should match what was set")
-	assert.Equal(t, auth.GetUserID(), updatedSettings.UserID, "User ID should match")
-	assert.Equal(t, auth.GetTenantID(), updatedSettings.TenantID, "Tenant ID should match")
-
-	// 4. Change settings again
-	newTheme := "light"
-	newLanguage := "en"
-
-	updatedSettings.Theme = newTheme
-	updatedSettings.Language = newLanguage
-
-	err = updateSettings(ctx, updatedSettings)
-	require.NoError(t, err, "Failed to update settings again")
-
-	// 5. Read settings back and verify they match the new values
-	finalSettings, err := getSettings(ctx)
-	require.NoError(t, err, "Failed to get final settings")
-	assert.Equal(t, newTheme, finalSettings.Theme, "Theme should match the new value")
-	assert.Equal(t, newLanguage, finalSettings.Language, "Language should match the new value")
-	assert.Equal(t, auth.GetUserID(), finalSettings.UserID, "User ID should match")
-	assert.Equal(t, auth.GetTenantID(), finalSettings.TenantID, "Tenant ID should match")
-
-	// 6. Verify direct database query also shows the updated values
-	var dbSettings Settings
-	result := testDB.Where("tenant_id = ? AND user_id = ?", auth.GetTenantID(), auth.GetUserID()).First(&dbSettings)
-	require.NoError(t, result.Error, "Failed to query settings directly from DB")
-	assert.Equal(t, newTheme, dbSettings.Theme, "DB theme should match")
-	assert.Equal(t, newLanguage, dbSettings.Language, "DB language should match")
-	assert.Equal(t, auth.GetUserID(), dbSettings.UserID, "DB user ID should match")
-	assert.Equal(t, auth.GetTenantID(), dbSettings.TenantID, "DB tenant ID should match")
+func TestRegisterRejectsDuplicateKey(t *testing.T) {
+	resetRegistry(t)
+	err := Register(SettingSchema{Key: "ui.theme", Scopes: []Scope{ScopeUser}})
+	require.Error(t, err, "registering an already-registered key should fail")
 }
@@ -0,0 +1,237 @@
+package settings
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/hypernetix/hyperspot/libs/db"
+	"github.com/hypernetix/hyperspot/libs/errorx"
+	"github.com/hypernetix/hyperspot/libs/logging"
+	"gorm.io/gorm"
+)
+
+// ScopeVersion tracks a monotonically increasing version per (scope,
+// scope_id), bumped on every write to any key within that scope. It backs
+// the optimistic-concurrency (If-Match/ETag) checks on the settings write
+// endpoints: a client must present the version it last read, so a write
+// based on stale data is rejected with 412 instead of silently clobbering a
+// concurrent edit.
+type ScopeVersion struct {
+	Scope   string `json:"-" db:"scope,primaryKey"`
+	ScopeID string `json:"-" db:"scope_id,primaryKey"`
+	Version int64  `json:"-" db:"version"`
+}
+
+func (ScopeVersion) TableName() string {
+	return "settings_scope_versions"
+}
+
+// getScopeVersion returns the current version for (scope, scopeID), or 0 if
+// the scope has never been written to.
+func getScopeVersion(scope Scope, scopeID string) (int64, errorx.Error) {
+	return getScopeVersionTx(db.DB(), scope, scopeID)
+}
+
+// getScopeVersionTx is getScopeVersion run against exec (db.DB() or a
+// transaction).
+func getScopeVersionTx(exec *gorm.DB, scope Scope, scopeID string) (int64, errorx.Error) {
+	var row ScopeVersion
+	err := exec.Where("scope = ? AND scope_id = ?", string(scope), scopeID).First(&row).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return 0, nil
+		}
+		return 0, errorx.NewErrInternalServerError("%s", err.Error())
+	}
+	return row.Version, nil
+}
+
+// bumpScopeVersionTx increments and persists the version for (scope,
+// scopeID) against exec, creating the row on first write. Callers must hold
+// mu.
+func bumpScopeVersionTx(exec *gorm.DB, scope Scope, scopeID string) (int64, errorx.Error) {
+	current, errx := getScopeVersionTx(exec, scope, scopeID)
+	if errx != nil {
+		return 0, errx
+	}
+	next := current + 1
+
+	row := ScopeVersion{Scope: string(scope), ScopeID: scopeID, Version: next}
+	if current == 0 {
+		if err := exec.Create(&row).Error; err != nil {
+			return 0, errorx.NewErrInternalServerError("failed to create scope version: %s", err.Error())
+		}
+	} else {
+		if err := exec.Where("scope = ? AND scope_id = ?", string(scope), scopeID).Updates(&row).Error; err != nil {
+			return 0, errorx.NewErrInternalServerError("failed to update scope version: %s", err.Error())
+		}
+	}
+	return next, nil
+}
+
+// formatETag renders a scope version as a quoted ETag value.
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag parses a quoted or bare If-Match value into a version. An empty
+// input returns (0, true) so callers can distinguish "not supplied" from a
+// malformed header.
+func parseETag(ifMatch string) (int64, bool) {
+	if ifMatch == "" {
+		return 0, true
+	}
+	trimmed := ifMatch
+	if len(trimmed) >= 2 && trimmed[0] == '"' && trimmed[len(trimmed)-1] == '"' {
+		trimmed = trimmed[1 : len(trimmed)-1]
+	}
+	version, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// applyScopeUpdate validates and persists every key in values for
+// (scope, scopeID) as a single compare-and-swap operation: if ifMatch is
+// non-empty it must equal the scope's current version, otherwise the scope
+// must not have been written to before (version 0). On success it returns
+// the new version, the full post-update key/value map for the scope, and
+// the history row recorded for the write.
+func applyScopeUpdate(ctx context.Context, scope Scope, scopeID string, values map[string]interface{}, ifMatch string) (int64, map[string]interface{}, *SettingsHistory, errorx.Error) {
+	expected, ok := parseETag(ifMatch)
+	if !ok {
+		return 0, nil, nil, errorx.NewErrBadRequest("malformed If-Match header: %q", ifMatch)
+	}
+
+	return applyScopeUpdateCAS(ctx, scope, scopeID, values, nil, ifMatch != "", expected, sourceAPI)
+}
+
+// forceApplyScopeUpdate persists values for (scope, scopeID) without a
+// version precondition. It is used by internal callers (history revert,
+// bundle import) that have already decided the write should happen
+// regardless of the scope's current version.
+func forceApplyScopeUpdate(ctx context.Context, scope Scope, scopeID string, values map[string]interface{}, source string) (int64, map[string]interface{}, *SettingsHistory, errorx.Error) {
+	return applyScopeUpdateCAS(ctx, scope, scopeID, values, nil, false, 0, source)
+}
+
+// forceApplyScopeRevert is forceApplyScopeUpdate plus a set of keys to
+// delete outright rather than set, for reverting a change that created
+// those keys (where there is no prior value to restore).
+func forceApplyScopeRevert(ctx context.Context, scope Scope, scopeID string, values map[string]interface{}, deleteKeys []string, source string) (int64, map[string]interface{}, *SettingsHistory, errorx.Error) {
+	return applyScopeUpdateCAS(ctx, scope, scopeID, values, deleteKeys, false, 0, source)
+}
+
+// applyScopeUpdateCAS is the shared core of applyScopeUpdate,
+// forceApplyScopeUpdate and forceApplyScopeRevert: it checks the version
+// precondition (expected must equal the current version when checkVersion
+// is set; a sourceAPI write without checkVersion requires version 0), then
+// applies every key/value, deletes every key in
+// deleteKeys, bumps the scope version, and records a history row, all
+// inside one GORM transaction.
+func applyScopeUpdateCAS(ctx context.Context, scope Scope, scopeID string, values map[string]interface{}, deleteKeys []string, checkVersion bool, expected int64, source string) (int64, map[string]interface{}, *SettingsHistory, errorx.Error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var newVersion int64
+	var history *SettingsHistory
+	diff := make(map[string]historyFieldDiff, len(values)+len(deleteKeys))
+
+	err := db.DB().Transaction(func(tx *gorm.DB) error {
+		current, errx := getScopeVersionTx(tx, scope, scopeID)
+		if errx != nil {
+			return errx
+		}
+		if checkVersion && expected != current {
+			return errorx.NewErrPreconditionFailed("If-Match version %d does not match current version %d", expected, current)
+		}
+		if !checkVersion && source == sourceAPI && current != 0 {
+			return errorx.NewErrPreconditionFailed("settings at %s scope have changed; supply the current If-Match version", scope)
+		}
+
+		for key, value := range values {
+			oldValue, _, errx := getValue(tx, scope, scopeID, key)
+			if errx != nil {
+				return errx
+			}
+			if errx := setValueLocked(tx, ctx, scope, scopeID, key, value); errx != nil {
+				return errx
+			}
+			diff[key] = historyFieldDiff{Old: oldValue, New: value}
+		}
+
+		for _, key := range deleteKeys {
+			oldValue, _, errx := getValue(tx, scope, scopeID, key)
+			if errx != nil {
+				return errx
+			}
+			if errx := deleteValueLocked(tx, scope, scopeID, key); errx != nil {
+				return errx
+			}
+			diff[key] = historyFieldDiff{Old: oldValue, New: nil}
+		}
+
+		newVersion, errx = bumpScopeVersionTx(tx, scope, scopeID)
+		if errx != nil {
+			return errx
+		}
+
+		var err error
+		history, err = recordHistory(tx, scope, scopeID, diff, newVersion, source)
+		return err
+	})
+	if err != nil {
+		if errx, ok := err.(errorx.Error); ok {
+			return 0, nil, nil, errx
+		}
+		return 0, nil, nil, errorx.NewErrInternalServerError("%s", err.Error())
+	}
+
+	updated, errx := listScope(db.DB(), scope, scopeID)
+	if errx != nil {
+		return 0, nil, nil, errx
+	}
+
+	for key, value := range values {
+		settingsBroker.publish(settingsEvent{Scope: scope, ScopeID: scopeID, Key: key, Value: value, Version: newVersion})
+	}
+	for _, key := range deleteKeys {
+		settingsBroker.publish(settingsEvent{Scope: scope, ScopeID: scopeID, Key: key, Value: nil, Version: newVersion})
+	}
+
+	return newVersion, updated, history, nil
+}
+
+var backfillScopeVersionsOnce sync.Once
+
+// backfillScopeVersions gives every (scope, scope_id) that already holds
+// settings rows but predates this migration a starting version of 1, so
+// existing clients don't get spurious 412s on their first write after
+// upgrade. It runs once, lazily, the first time the API routes are wired up
+// (by which point migrations have applied the settings_scope_versions
+// table).
+func backfillScopeVersions() {
+	var scopes []struct {
+		Scope   string
+		ScopeID string
+	}
+	if err := db.DB().Model(&SettingRecord{}).Distinct("scope", "scope_id").Find(&scopes).Error; err != nil {
+		logging.Error("settings: failed to enumerate scopes for version backfill: %s", err.Error())
+		return
+	}
+
+	for _, s := range scopes {
+		var count int64
+		if err := db.DB().Model(&ScopeVersion{}).Where("scope = ? AND scope_id = ?", s.Scope, s.ScopeID).Count(&count).Error; err != nil {
+			logging.Error("settings: failed to check scope version for %s/%s: %s", s.Scope, s.ScopeID, err.Error())
+			continue
+		}
+		if count > 0 {
+			continue
+		}
+		if err := db.DB().Create(&ScopeVersion{Scope: s.Scope, ScopeID: s.ScopeID, Version: 1}).Error; err != nil {
+			logging.Error("settings: failed to backfill scope version for %s/%s: %s", s.Scope, s.ScopeID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package settings
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyScopeUpdateCAS(t *testing.T) {
+	testDB := setupTestDB(t)
+	defer func() {
+		sqlDB, _ := testDB.DB()
+		sqlDB.Close()
+	}()
+	resetRegistry(t)
+
+	ctx := context.Background()
+
+	// First write with no version requires no If-Match.
+	version, values, _, errx := applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "dark"}, "")
+	require.NoError(t, errx)
+	assert.Equal(t, int64(1), version)
+	assert.Equal(t, "dark", values["ui.theme"])
+
+	// A second write without If-Match is rejected now that a version exists.
+	_, _, _, errx = applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "light"}, "")
+	require.Error(t, errx, "write without If-Match should fail once a version exists")
+
+	// Writing with a stale If-Match is rejected.
+	_, _, _, errx = applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "light"}, `"0"`)
+	require.Error(t, errx, "write with stale If-Match should fail")
+
+	// Writing with the current If-Match succeeds and bumps the version.
+	version, values, _, errx = applyScopeUpdate(ctx, ScopeSystem, "", map[string]interface{}{"ui.theme": "light"}, formatETag(1))
+	require.NoError(t, errx)
+	assert.Equal(t, int64(2), version)
+	assert.Equal(t, "light", values["ui.theme"])
+}
+
+func TestParseETag(t *testing.T) {
+	version, ok := parseETag(`"42"`)
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), version)
+
+	version, ok = parseETag("7")
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), version)
+
+	version, ok = parseETag("")
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), version)
+
+	_, ok = parseETag("not-a-number")
+	assert.False(t, ok)
+}